@@ -47,11 +47,11 @@ func (m *Map) expandProps(str string, debug bool) string {
 			fmt.Printf("pass %d: %s\n", i, str)
 		}
 		newStr := str
-		for key, value := range m.kv {
+		for key, e := range m.kv {
 			if debug && strings.Contains(newStr, "{"+key+"}") {
-				fmt.Printf("  Replacing %s -> %s\n", key, value)
+				fmt.Printf("  Replacing %s -> %s\n", key, e.value)
 			}
-			newStr = strings.Replace(newStr, "{"+key+"}", value, -1)
+			newStr = strings.Replace(newStr, "{"+key+"}", e.value, -1)
 		}
 		if str == newStr {
 			break
@@ -64,8 +64,8 @@ func (m *Map) expandProps(str string, debug bool) string {
 // Dump returns a representation of the map in golang source format
 func (m *Map) Dump() string {
 	res := "properties.Map{\n"
-	for _, k := range m.o {
-		res += fmt.Sprintf("  \"%s\": \"%s\",\n", strings.Replace(k, `"`, `\"`, -1), strings.Replace(m.Get(k), `"`, `\"`, -1))
+	for e := m.head; e != nil; e = e.next {
+		res += fmt.Sprintf("  \"%s\": \"%s\",\n", strings.Replace(e.key, `"`, `\"`, -1), strings.Replace(e.value, `"`, `\"`, -1))
 	}
 	res += "}"
 	return res
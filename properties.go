@@ -69,7 +69,10 @@ so there are some methods to help this task like SplitQuotedString or ExpandProp
 package properties
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -84,10 +87,25 @@ import (
 	"github.com/arduino/go-paths-helper"
 )
 
+// entry is a node of the doubly linked list that backs Map, used to keep
+// insertion order while making Set/Remove O(1).
+type entry struct {
+	key   string
+	value string
+	prev  *entry
+	next  *entry
+}
+
 // Map is a container of properties
 type Map struct {
-	kv map[string]string
-	o  []string
+	kv   map[string]*entry
+	head *entry
+	tail *entry
+
+	// comments holds the comment lines recorded by LoadStrict (or attached
+	// with SetComments) that immediately precede a given key, so Store can
+	// re-emit them.
+	comments map[string][]string
 
 	// Debug if set to true ExpandPropsInString will always output debugging information
 	Debug bool
@@ -117,8 +135,7 @@ func SetOSSuffix(suffix string) {
 // NewMap returns a new Map
 func NewMap() *Map {
 	return &Map{
-		kv: map[string]string{},
-		o:  []string{},
+		kv: map[string]*entry{},
 	}
 }
 
@@ -140,21 +157,32 @@ func toUtf8(iso8859_1_buf []byte) string {
 	return string(buf)
 }
 
-// LoadFromBytes reads properties data and makes a Map out of it.
-func LoadFromBytes(bytes []byte) (*Map, error) {
+// LoadFromBytes reads properties data and makes a Map out of it. The data
+// is parsed following the conventions of the Java `.properties` format:
+// `#` and `!` both start a comment line, `=` and `:` are both accepted as
+// key/value separators, a trailing unescaped `\` continues the logical
+// line onto the next physical line, and `\n`, `\t`, `\r`, `\\`, `\=`, `\:`,
+// `\ ` and `\uXXXX` escapes are decoded in both keys and values.
+func LoadFromBytes(data []byte) (*Map, error) {
 	var text string
-	if utf8.Valid(bytes) {
-		text = string(bytes)
+	if utf8.Valid(data) {
+		text = string(data)
 	} else {
 		// Assume ISO8859-1 encoding and convert to UTF-8
-		text = toUtf8(bytes)
+		text = toUtf8(data)
 	}
 	text = strings.Replace(text, "\r\n", "\n", -1)
 	text = strings.Replace(text, "\r", "\n", -1)
 
 	properties := NewMap()
 
-	for lineNum, line := range strings.Split(text, "\n") {
+	lines := strings.Split(text, "\n")
+	for lineNum := 0; lineNum < len(lines); lineNum++ {
+		line := lines[lineNum]
+		for hasLineContinuation(line) && lineNum+1 < len(lines) {
+			lineNum++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[lineNum], " \t\f")
+		}
 		if err := properties.parseLine(line); err != nil {
 			return nil, fmt.Errorf("error parsing data at line %d: %s", lineNum, err)
 		}
@@ -163,6 +191,122 @@ func LoadFromBytes(bytes []byte) (*Map, error) {
 	return properties, nil
 }
 
+// WriteToBytes serializes the Map into the standard `.properties` file
+// format as `key=value` lines in insertion order, escaping the characters
+// that would otherwise be ambiguous (`=`, `:`, whitespace, control
+// characters and a leading `#` or `!`) so that the result can be read
+// back unchanged with LoadFromBytes.
+func (m *Map) WriteToBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	for e := m.head; e != nil; e = e.next {
+		if !utf8.ValidString(e.key) || !utf8.ValidString(e.value) {
+			return nil, fmt.Errorf("invalid utf8 data in property %s", e.key)
+		}
+		buf.WriteString(escapePropertiesKey(e.key))
+		buf.WriteByte('=')
+		buf.WriteString(escapePropertiesValue(e.value))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Save writes the Map to filepath in the standard `.properties` file format.
+func (m *Map) Save(filepath string) error {
+	data, err := m.WriteToBytes()
+	if err != nil {
+		return fmt.Errorf("error serializing properties: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath, data, 0644); err != nil {
+		return fmt.Errorf("error writing file: %s", err)
+	}
+	return nil
+}
+
+// SaveToPath writes the Map to the given path in the standard `.properties` file format.
+func (m *Map) SaveToPath(path *paths.Path) error {
+	return m.Save(path.String())
+}
+
+// hasLineContinuation returns true if line ends with an odd number of
+// trailing backslashes, meaning the last one is an unescaped continuation
+// marker that folds the next physical line into this logical line.
+func hasLineContinuation(line string) bool {
+	count := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+// escapePropertiesKey escapes a key for use in the standard `.properties`
+// file format: every space is escaped (so a leading or trailing space
+// survives the key trimming performed while parsing) and a leading `#` or
+// `!` is escaped so it is not mistaken for a comment marker.
+func escapePropertiesKey(s string) string {
+	return escapeProperties(s, true, false)
+}
+
+// escapePropertiesValue escapes a value for use in the standard
+// `.properties` file format. Only a leading space is escaped, since
+// LoadFromBytes strips unescaped leading whitespace from values.
+func escapePropertiesValue(s string) string {
+	return escapeProperties(s, false, false)
+}
+
+// escapeProperties escapes s for use as a key (isKey) or value in a
+// `.properties` file. When asciiOnly is set, every non-ASCII code point is
+// also escaped as \uXXXX, matching java.util.Properties.store's default
+// output encoding.
+func escapeProperties(s string, isKey bool, asciiOnly bool) string {
+	var buf strings.Builder
+	first := true
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '=':
+			buf.WriteString(`\=`)
+		case r == ':':
+			buf.WriteString(`\:`)
+		case r == ' ':
+			if isKey || first {
+				buf.WriteString(`\ `)
+			} else {
+				buf.WriteRune(' ')
+			}
+		case r == '#' || r == '!':
+			if isKey && first {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(r)
+		case asciiOnly && r > 0x7E:
+			if r > 0xFFFF {
+				// java.util.Properties.store only ever emits 4 hex digits
+				// per \u escape, so code points outside the BMP must be
+				// split into a UTF-16 surrogate pair, same as java.util.Properties.
+				r -= 0x10000
+				hi := 0xD800 + (r >> 10)
+				lo := 0xDC00 + (r & 0x3FF)
+				fmt.Fprintf(&buf, `\u%04x\u%04x`, hi, lo)
+			} else {
+				fmt.Fprintf(&buf, `\u%04x`, r)
+			}
+		default:
+			buf.WriteRune(r)
+		}
+		first = false
+	}
+	return buf.String()
+}
+
 // Load reads a properties file and makes a Map out of it.
 func Load(filepath string) (*Map, error) {
 	bytes, err := ioutil.ReadFile(filepath)
@@ -182,6 +326,207 @@ func LoadFromPath(path *paths.Path) (*Map, error) {
 	return Load(path.String())
 }
 
+// LoadStrict reads a properties file following the full java.util.Properties
+// grammar: `=`, `:` and plain whitespace are all valid key/value separators,
+// and any `#`/`!` comment lines immediately preceding a key are recorded and
+// made available through CommentsFor so Store can re-emit them.
+func LoadStrict(filepath string) (*Map, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %s", err)
+	}
+
+	res, err := LoadStrictFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %s", err)
+	}
+	return res, nil
+}
+
+// LoadStrictFromBytes is like LoadStrict but reads properties data from an
+// in-memory buffer instead of a file.
+func LoadStrictFromBytes(data []byte) (*Map, error) {
+	var text string
+	if utf8.Valid(data) {
+		text = string(data)
+	} else {
+		// Assume ISO8859-1 encoding and convert to UTF-8
+		text = toUtf8(data)
+	}
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+
+	properties := NewMap()
+	var pendingComments []string
+
+	lines := strings.Split(text, "\n")
+	for lineNum := 0; lineNum < len(lines); lineNum++ {
+		line := lines[lineNum]
+		for hasLineContinuation(line) && lineNum+1 < len(lines) {
+			lineNum++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[lineNum], " \t\f")
+		}
+
+		trimmed := strings.TrimLeft(line, " \t\f")
+		if len(trimmed) == 0 {
+			pendingComments = nil
+			continue
+		}
+		if trimmed[0] == '#' || trimmed[0] == '!' {
+			pendingComments = append(pendingComments, trimmed[1:])
+			continue
+		}
+
+		key, value, col, err := splitKeyValue(trimmed, true)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing data at line %d, column %d: %s", lineNum+1, col, err)
+		}
+
+		key = strings.Replace(key, "."+osSuffix, "", 1)
+		properties.Set(key, value)
+		if len(pendingComments) > 0 {
+			properties.SetComments(key, pendingComments)
+		}
+		pendingComments = nil
+	}
+
+	return properties, nil
+}
+
+// CommentsFor returns the comment lines immediately preceding key, as
+// recorded by LoadStrict or attached with SetComments, in the order they
+// appeared in the source text. It returns nil if key has no comments.
+func (m *Map) CommentsFor(key string) []string {
+	return m.comments[key]
+}
+
+// SetComments attaches comment lines to key so that Store re-emits them,
+// each prefixed with `#`, immediately above the "key=value" line.
+func (m *Map) SetComments(key string, comments []string) {
+	if m.comments == nil {
+		m.comments = map[string][]string{}
+	}
+	m.comments[key] = comments
+}
+
+// StoreOptions configures how Store serializes a Map.
+type StoreOptions struct {
+	// WriteASCIIOnly escapes every non-ASCII code point in keys and values
+	// as \uXXXX, matching the default output encoding of
+	// java.util.Properties.store.
+	WriteASCIIOnly bool
+}
+
+// Store serializes the Map following the java.util.Properties.store
+// conventions: comments recorded via SetComments (or loaded with
+// LoadStrict) are re-emitted immediately above their key, and
+// opts.WriteASCIIOnly controls whether non-ASCII characters are escaped as
+// \uXXXX.
+func (m *Map) Store(opts StoreOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	for e := m.head; e != nil; e = e.next {
+		if !utf8.ValidString(e.key) || !utf8.ValidString(e.value) {
+			return nil, fmt.Errorf("invalid utf8 data in property %s", e.key)
+		}
+		for _, comment := range m.comments[e.key] {
+			buf.WriteByte('#')
+			buf.WriteString(comment)
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(escapeProperties(e.key, true, opts.WriteASCIIOnly))
+		buf.WriteByte('=')
+		buf.WriteString(escapeProperties(e.value, false, opts.WriteASCIIOnly))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveStrict writes the Map to filepath following the
+// java.util.Properties.store conventions.
+func (m *Map) SaveStrict(filepath string, opts StoreOptions) error {
+	data, err := m.Store(opts)
+	if err != nil {
+		return fmt.Errorf("error serializing properties: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath, data, 0644); err != nil {
+		return fmt.Errorf("error writing file: %s", err)
+	}
+	return nil
+}
+
+// SaveStrictToPath writes the Map to the given path following the
+// java.util.Properties.store conventions.
+func (m *Map) SaveStrictToPath(path *paths.Path, opts StoreOptions) error {
+	return m.SaveStrict(path.String(), opts)
+}
+
+// ParseError describes a single malformed line encountered while parsing a
+// `.properties` stream with LoadAll.
+type ParseError struct {
+	Line   int    // 1-based line number the malformed logical line started at
+	Column int    // 1-based rune position within Raw where parsing gave up
+	Raw    string // the raw (continuation-joined) line text
+	Msg    string // human readable description of the problem
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("error parsing data at line %d, column %d: %s: %s", e.Line, e.Column, e.Msg, e.Raw)
+}
+
+// LoadFromReader reads properties data from r, scanning it line-by-line
+// instead of buffering the whole stream in memory, and makes a Map out of
+// it. If any line is malformed it returns a nil Map and the ParseError of
+// the first malformed line; use LoadAll to collect every malformed line in
+// a single pass instead.
+func LoadFromReader(r io.Reader) (*Map, error) {
+	m, errs := LoadAll(r)
+	if len(errs) > 0 {
+		return nil, &errs[0]
+	}
+	return m, nil
+}
+
+// LoadAll reads properties data from r line-by-line, returning the Map
+// built from every well-formed line together with a ParseError for every
+// malformed one it encountered along the way. This lets tools that ingest
+// large or partially corrupt board/platform files report every problem
+// they contain in a single pass instead of failing on the first bad line.
+func LoadAll(r io.Reader) (*Map, []ParseError) {
+	properties := NewMap()
+	var errs []ParseError
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		startLine := lineNum
+		line := strings.TrimRight(scanner.Text(), "\r")
+		for hasLineContinuation(line) && scanner.Scan() {
+			lineNum++
+			line = line[:len(line)-1] + strings.TrimLeft(strings.TrimRight(scanner.Text(), "\r"), " \t\f")
+		}
+
+		key, value, col, ok, err := parseLogicalLine(line)
+		if err != nil {
+			errs = append(errs, ParseError{Line: startLine, Column: col, Raw: line, Msg: err.Error()})
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		key = strings.Replace(key, "."+osSuffix, "", 1)
+		properties.Set(key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, ParseError{Line: lineNum + 1, Column: 0, Raw: "", Msg: fmt.Sprintf("scanner error: %s", err)})
+	}
+
+	return properties, errs
+}
+
 // LoadFromSlice reads a properties file from an array of string
 // and makes a Map out of it
 func LoadFromSlice(lines []string) (*Map, error) {
@@ -197,19 +542,13 @@ func LoadFromSlice(lines []string) (*Map, error) {
 }
 
 func (m *Map) parseLine(line string) error {
-	line = strings.TrimSpace(line)
-
-	// Skip empty lines or comments
-	if len(line) == 0 || line[0] == '#' {
-		return nil
+	key, value, _, ok, err := parseLogicalLine(line)
+	if err != nil {
+		return err
 	}
-
-	lineParts := strings.SplitN(line, "=", 2)
-	if len(lineParts) != 2 {
-		return fmt.Errorf("invalid line format, should be 'key=value'")
+	if !ok {
+		return nil
 	}
-	key := strings.TrimSpace(lineParts[0])
-	value := strings.TrimSpace(lineParts[1])
 
 	key = strings.Replace(key, "."+osSuffix, "", 1)
 	m.Set(key, value)
@@ -217,6 +556,149 @@ func (m *Map) parseLine(line string) error {
 	return nil
 }
 
+// parseLogicalLine parses a single already continuation-joined properties
+// line. ok is false with a nil error when the line is blank or a comment
+// and should simply be skipped; col is only meaningful when err is not nil,
+// and reports the 1-based rune position the parser gave up at.
+func parseLogicalLine(line string) (key, value string, col int, ok bool, err error) {
+	trimmed := strings.TrimLeft(line, " \t\f")
+
+	// Skip empty lines or comments
+	if len(trimmed) == 0 || trimmed[0] == '#' || trimmed[0] == '!' {
+		return "", "", 0, false, nil
+	}
+
+	key, value, col, err = splitKeyValue(trimmed, false)
+	if err != nil {
+		// col is relative to trimmed; shift it back so it lands on the
+		// same rune within the untrimmed line stored as ParseError.Raw.
+		return "", "", col + len([]rune(line)) - len([]rune(trimmed)), false, err
+	}
+	return key, value, 0, true, nil
+}
+
+// splitKeyValue splits a single logical properties line into its key and
+// value, decoding the Java `.properties` escapes (`\n`, `\t`, `\r`, `\f`,
+// `\\`, `\=`, `\:`, `\ ` and `\uXXXX`) along the way. The key/value
+// separator is the first unescaped `=` or `:`; any leading whitespace in
+// the value is discarded. When allowWhitespaceSep is set, plain whitespace
+// is also accepted as a separator on its own, matching the full
+// java.util.Properties grammar used by LoadStrict. On error, col reports
+// the 1-based rune position the parser gave up at.
+func splitKeyValue(line string, allowWhitespaceSep bool) (key, value string, col int, err error) {
+	runes := []rune(line)
+
+	var keyBuf strings.Builder
+	// keyEnd is the length of keyBuf up to its last escaped or
+	// non-whitespace rune, so only unescaped trailing whitespace is trimmed.
+	keyEnd := 0
+	i := 0
+	sepFound := false
+	for i < len(runes) {
+		c := runes[i]
+		isWhitespace := c == ' ' || c == '\t' || c == '\f'
+		if c == '=' || c == ':' || (allowWhitespaceSep && isWhitespace) {
+			sepFound = true
+			break
+		}
+		if c == '\\' {
+			r, consumed, err := decodeEscape(runes, i)
+			if err != nil {
+				return "", "", i + 1, err
+			}
+			keyBuf.WriteRune(r)
+			keyEnd = keyBuf.Len()
+			i += consumed
+			continue
+		}
+		keyBuf.WriteRune(c)
+		if !isWhitespace {
+			keyEnd = keyBuf.Len()
+		}
+		i++
+	}
+	if !sepFound {
+		return "", "", len(runes) + 1, fmt.Errorf("invalid line format, should be 'key=value'")
+	}
+
+	// Consume the separator: a literal '=' or ':' right here, or (only in
+	// whitespace-separator mode) a run of whitespace optionally followed by
+	// one more '=' or ':' and more whitespace.
+	if runes[i] == '=' || runes[i] == ':' {
+		i++
+	}
+	for i < len(runes) && (runes[i] == ' ' || runes[i] == '\t' || runes[i] == '\f') {
+		i++
+	}
+	if allowWhitespaceSep && i < len(runes) && (runes[i] == '=' || runes[i] == ':') {
+		i++
+		for i < len(runes) && (runes[i] == ' ' || runes[i] == '\t' || runes[i] == '\f') {
+			i++
+		}
+	}
+
+	var valueBuf strings.Builder
+	for i < len(runes) {
+		c := runes[i]
+		if c == '\\' {
+			r, consumed, err := decodeEscape(runes, i)
+			if err != nil {
+				return "", "", i + 1, err
+			}
+			valueBuf.WriteRune(r)
+			i += consumed
+			continue
+		}
+		valueBuf.WriteRune(c)
+		i++
+	}
+
+	return keyBuf.String()[:keyEnd], valueBuf.String(), 0, nil
+}
+
+// decodeEscape decodes the escape sequence starting at runes[i] (which
+// must be a backslash) and returns the decoded rune together with the
+// number of runes it consumed.
+func decodeEscape(runes []rune, i int) (rune, int, error) {
+	if i+1 >= len(runes) {
+		return 0, 0, fmt.Errorf("dangling escape character at end of line")
+	}
+	switch runes[i+1] {
+	case 'n':
+		return '\n', 2, nil
+	case 't':
+		return '\t', 2, nil
+	case 'r':
+		return '\r', 2, nil
+	case 'f':
+		return '\f', 2, nil
+	case 'u':
+		if i+6 > len(runes) {
+			return 0, 0, fmt.Errorf("invalid \\u escape: not enough hex digits")
+		}
+		code, err := strconv.ParseUint(string(runes[i+2:i+6]), 16, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid \\u escape: %s", err)
+		}
+		// A high surrogate is only ever emitted as the first half of a
+		// UTF-16 surrogate pair (see escapeProperties); if a matching low
+		// surrogate follows, combine them back into the single code point
+		// they represent instead of emitting an invalid lone surrogate.
+		if code >= 0xD800 && code <= 0xDBFF && i+12 <= len(runes) && runes[i+6] == '\\' && runes[i+7] == 'u' {
+			low, err := strconv.ParseUint(string(runes[i+8:i+12]), 16, 32)
+			if err == nil && low >= 0xDC00 && low <= 0xDFFF {
+				combined := 0x10000 + (code-0xD800)<<10 + (low - 0xDC00)
+				return rune(combined), 12, nil
+			}
+		}
+		return rune(code), 6, nil
+	default:
+		// Any other escaped character (including \\, \=, \: and \ ) is
+		// taken literally.
+		return runes[i+1], 2, nil
+	}
+}
+
 // SafeLoadFromPath is like LoadFromPath, except that it returns an empty Map if
 // the specified file doesn't exist
 func SafeLoadFromPath(path *paths.Path) (*Map, error) {
@@ -240,14 +722,19 @@ func SafeLoad(filepath string) (*Map, error) {
 
 // Get retrieves the value corresponding to key
 func (m *Map) Get(key string) string {
-	return m.kv[key]
+	if e, has := m.kv[key]; has {
+		return e.value
+	}
+	return ""
 }
 
 // GetOk retrieves the value corresponding to key and returns a true/false indicator
 // to check if the key is present in the map (true if the key is present)
 func (m *Map) GetOk(key string) (string, bool) {
-	v, ok := m.kv[key]
-	return v, ok
+	if e, has := m.kv[key]; has {
+		return e.value, true
+	}
+	return "", false
 }
 
 // ContainsKey returns true if the map contains the specified key
@@ -258,21 +745,27 @@ func (m *Map) ContainsKey(key string) bool {
 
 // ContainsValue returns true if the map contains the specified value
 func (m *Map) ContainsValue(value string) bool {
-	for _, v := range m.kv {
-		if v == value {
+	for _, e := range m.kv {
+		if e.value == value {
 			return true
 		}
 	}
 	return false
 }
 
-// Set inserts or replaces an existing key-value pair in the map
+// Set inserts or replaces an existing key-value pair in the map. Overwriting
+// an existing key moves it to the end of the insertion order, matching the
+// previous remove-then-append behaviour.
 func (m *Map) Set(key, value string) {
-	if _, has := m.kv[key]; has {
-		m.Remove(key)
+	if e, has := m.kv[key]; has {
+		m.unlink(e)
+		e.value = value
+		m.linkTail(e)
+		return
 	}
-	m.kv[key] = value
-	m.o = append(m.o, key)
+	e := &entry{key: key, value: value}
+	m.kv[key] = e
+	m.linkTail(e)
 }
 
 // Size returns the number of elements in the map
@@ -282,13 +775,41 @@ func (m *Map) Size() int {
 
 // Remove removes the key from the map
 func (m *Map) Remove(key string) {
+	e, has := m.kv[key]
+	if !has {
+		return
+	}
+	m.unlink(e)
 	delete(m.kv, key)
-	for i, k := range m.o {
-		if k == key {
-			m.o = append(m.o[:i], m.o[i+1:]...)
-			return
-		}
+	delete(m.comments, key)
+}
+
+// unlink removes e from the insertion-order linked list without touching m.kv.
+func (m *Map) unlink(e *entry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		m.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		m.tail = e.prev
 	}
+	e.prev = nil
+	e.next = nil
+}
+
+// linkTail appends e at the end of the insertion-order linked list.
+func (m *Map) linkTail(e *entry) {
+	e.prev = m.tail
+	e.next = nil
+	if m.tail != nil {
+		m.tail.next = e
+	} else {
+		m.head = e
+	}
+	m.tail = e
 }
 
 // FirstLevelOf generates a map-of-Maps using the first level of the hierarchy
@@ -325,16 +846,15 @@ func (m *Map) Remove(key string) {
 //	}
 func (m *Map) FirstLevelOf() map[string]*Map {
 	newMap := make(map[string]*Map)
-	for _, key := range m.o {
-		if !strings.Contains(key, ".") {
+	for e := m.head; e != nil; e = e.next {
+		if !strings.Contains(e.key, ".") {
 			continue
 		}
-		keyParts := strings.SplitN(key, ".", 2)
+		keyParts := strings.SplitN(e.key, ".", 2)
 		if newMap[keyParts[0]] == nil {
 			newMap[keyParts[0]] = NewMap()
 		}
-		value := m.kv[key]
-		newMap[keyParts[0]].Set(keyParts[1], value)
+		newMap[keyParts[0]].Set(keyParts[1], e.value)
 	}
 	return newMap
 }
@@ -365,8 +885,8 @@ func (m *Map) FirstLevelOf() map[string]*Map {
 func (m *Map) FirstLevelKeys() []string {
 	res := []string{}
 	taken := map[string]bool{}
-	for _, k := range m.o {
-		first := strings.SplitN(k, ".", 2)[0]
+	for e := m.head; e != nil; e = e.next {
+		first := strings.SplitN(e.key, ".", 2)[0]
 		if taken[first] {
 			continue
 		}
@@ -403,12 +923,11 @@ func (m *Map) FirstLevelKeys() []string {
 func (m *Map) SubTree(rootKey string) *Map {
 	rootKey += "."
 	newMap := NewMap()
-	for _, key := range m.o {
-		if !strings.HasPrefix(key, rootKey) {
+	for e := m.head; e != nil; e = e.next {
+		if !strings.HasPrefix(e.key, rootKey) {
 			continue
 		}
-		value := m.kv[key]
-		newMap.Set(key[len(rootKey):], value)
+		newMap.Set(e.key[len(rootKey):], e.value)
 	}
 	return newMap
 }
@@ -458,13 +977,123 @@ func (m *Map) IsPropertyMissingInExpandPropsInString(prop, str string) bool {
 	return strings.Contains(res, token)
 }
 
+// ExpandOptions configures the recursive expansion performed by
+// ExpandPropsInStringWithOptions.
+type ExpandOptions struct {
+	// Open and Close delimit a placeholder; they default to "{" and "}"
+	// when left empty. Use this to expand strings whose values legitimately
+	// contain braces, such as JSON or C initializer lists.
+	Open, Close string
+
+	// MaxDepth bounds how many placeholders may be nested inside one
+	// another. A value <= 0 means unlimited.
+	MaxDepth int
+
+	// OnCycle is called when a placeholder refers back to a key that is
+	// already being expanded. chain lists the keys from the outermost
+	// reference down to the repeated one. If OnCycle is nil, the
+	// placeholder is left untouched, matching ExpandPropsInString.
+	OnCycle func(chain []string) string
+
+	// OnMissing is called when a placeholder refers to a key not present
+	// in the Map. If it returns ok == false, or OnMissing is nil, the
+	// placeholder is left untouched, matching ExpandPropsInString.
+	OnMissing func(key string) (string, bool)
+}
+
+// ExpandPropsInStringWithOptions works like ExpandPropsInString but expands
+// placeholders recursively via a depth-first traversal instead of in a
+// bounded number of passes, so nested references are always fully resolved.
+// Reference cycles are detected (instead of silently looping) and reported
+// through opts.OnCycle, missing keys through opts.OnMissing, and the
+// placeholder delimiters can be customized through opts.Open/opts.Close.
+// It returns the expanded string together with the keys that were actually
+// referenced during expansion, in the order they were first encountered.
+func (m *Map) ExpandPropsInStringWithOptions(str string, opts ExpandOptions) (string, []string) {
+	if opts.Open == "" {
+		opts.Open = "{"
+	}
+	if opts.Close == "" {
+		opts.Close = "}"
+	}
+
+	referenced := []string{}
+	seen := map[string]bool{}
+	res := m.expandRecursive(str, opts, nil, 0, &referenced, seen)
+	return res, referenced
+}
+
+// expandRecursive expands every opts.Open...opts.Close placeholder found in
+// str, descending into the value of each referenced key. stack holds the
+// keys currently being expanded, innermost last, and is used to detect
+// cycles.
+func (m *Map) expandRecursive(str string, opts ExpandOptions, stack []string, depth int, referenced *[]string, seen map[string]bool) string {
+	var buf strings.Builder
+	rest := str
+	for {
+		start := strings.Index(rest, opts.Open)
+		if start < 0 {
+			buf.WriteString(rest)
+			break
+		}
+		end := strings.Index(rest[start+len(opts.Open):], opts.Close)
+		if end < 0 {
+			buf.WriteString(rest)
+			break
+		}
+		end += start + len(opts.Open)
+		buf.WriteString(rest[:start])
+		key := rest[start+len(opts.Open) : end]
+		buf.WriteString(m.expandKey(key, opts, stack, depth, referenced, seen))
+		rest = rest[end+len(opts.Close):]
+	}
+	return buf.String()
+}
+
+// expandKey resolves a single placeholder key, recursing into its value
+// (tracking key on stack for cycle detection) unless opts.MaxDepth has been
+// reached.
+func (m *Map) expandKey(key string, opts ExpandOptions, stack []string, depth int, referenced *[]string, seen map[string]bool) string {
+	for _, k := range stack {
+		if k == key {
+			if opts.OnCycle != nil {
+				return opts.OnCycle(append(append([]string{}, stack...), key))
+			}
+			return opts.Open + key + opts.Close
+		}
+	}
+
+	value, ok := m.GetOk(key)
+	if !ok {
+		if opts.OnMissing != nil {
+			if v, ok := opts.OnMissing(key); ok {
+				return v
+			}
+		}
+		return opts.Open + key + opts.Close
+	}
+
+	if !seen[key] {
+		seen[key] = true
+		*referenced = append(*referenced, key)
+	}
+
+	if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+		return value
+	}
+
+	return m.expandRecursive(value, opts, append(stack, key), depth+1, referenced, seen)
+}
+
 // Merge merges other Maps into this one. Each key/value of the merged Maps replaces
 // the key/value present in the original Map.
 func (m *Map) Merge(sources ...*Map) *Map {
 	for _, source := range sources {
-		for _, key := range source.o {
-			value := source.kv[key]
-			m.Set(key, value)
+		for e := source.head; e != nil; e = e.next {
+			m.Set(e.key, e.value)
+			if comments, has := source.comments[e.key]; has {
+				m.SetComments(e.key, comments)
+			}
 		}
 	}
 	return m
@@ -472,33 +1101,40 @@ func (m *Map) Merge(sources ...*Map) *Map {
 
 // Keys returns an array of the keys contained in the Map
 func (m *Map) Keys() []string {
-	keys := make([]string, len(m.o))
-	copy(keys, m.o)
+	keys := make([]string, 0, len(m.kv))
+	for e := m.head; e != nil; e = e.next {
+		keys = append(keys, e.key)
+	}
 	return keys
 }
 
 // Values returns an array of the values contained in the Map. Duplicated
 // values are repeated in the list accordingly.
 func (m *Map) Values() []string {
-	values := make([]string, len(m.o))
-	for i, key := range m.o {
-		values[i] = m.kv[key]
+	values := make([]string, 0, len(m.kv))
+	for e := m.head; e != nil; e = e.next {
+		values = append(values, e.value)
 	}
 	return values
 }
 
-// AsMap returns the underlying map[string]string. This is useful if you need to
-// for ... range but without the requirement of the ordered elements.
+// AsMap returns a map[string]string holding a copy of the Map's key/value
+// pairs. This is useful if you need to for ... range but without the
+// requirement of the ordered elements.
 func (m *Map) AsMap() map[string]string {
-	return m.kv
+	res := make(map[string]string, len(m.kv))
+	for e := m.head; e != nil; e = e.next {
+		res[e.key] = e.value
+	}
+	return res
 }
 
 // AsSlice returns the underlying map[string]string as a slice of
 // strings with the pattern `{key}={value}`, maintaining the insertion order of the keys.
 func (m *Map) AsSlice() []string {
-	properties := make([]string, len(m.o))
-	for i, key := range m.o {
-		properties[i] = strings.Join([]string{key, m.kv[key]}, "=")
+	properties := make([]string, 0, len(m.kv))
+	for e := m.head; e != nil; e = e.next {
+		properties = append(properties, strings.Join([]string{e.key, e.value}, "="))
 	}
 	return properties
 }
@@ -513,13 +1149,22 @@ func (m *Map) Clone() *Map {
 // Equals returns true if the current Map contains the same key/value pairs of
 // the Map passed as argument, the order of insertion does not matter.
 func (m *Map) Equals(other *Map) bool {
-	return reflect.DeepEqual(m.kv, other.kv)
+	if len(m.kv) != len(other.kv) {
+		return false
+	}
+	for k, e := range m.kv {
+		oe, has := other.kv[k]
+		if !has || oe.value != e.value {
+			return false
+		}
+	}
+	return true
 }
 
 // EqualsWithOrder returns true if the current Map contains the same key/value pairs of
 // the Map passed as argument with the same order of insertion.
 func (m *Map) EqualsWithOrder(other *Map) bool {
-	return reflect.DeepEqual(m.o, other.o) && reflect.DeepEqual(m.kv, other.kv)
+	return reflect.DeepEqual(m.Keys(), other.Keys()) && m.Equals(other)
 }
 
 // MergeMapsOfProperties merges the map-of-Maps (obtained from the method FirstLevelOf()) into the
@@ -668,11 +1313,11 @@ func (m *Map) ExtractSubIndexLists(root string) []string {
 	// Extract numeric keys
 	subProps := m.SubTree(root)
 	indexes := []int{}
-	for _, key := range subProps.o {
-		if isNotDigit(key) {
+	for e := subProps.head; e != nil; e = e.next {
+		if isNotDigit(e.key) {
 			continue
 		}
-		if idx, err := strconv.Atoi(key); err == nil {
+		if idx, err := strconv.Atoi(e.key); err == nil {
 			indexes = append(indexes, idx)
 		}
 	}
@@ -31,10 +31,12 @@ package properties
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/arduino/go-paths-helper"
@@ -383,6 +385,83 @@ func TestLoadingNonUTF8Properties(t *testing.T) {
 	require.Equal(t, "Aáa", m.Get("maintainer"))
 }
 
+func TestWriteToBytesRoundTrip(t *testing.T) {
+	m := NewMap()
+	m.Set("yun.upload.tool", "avrdude")
+	m.Set("yun.upload.speed", "57600")
+	m.Set("key with spaces", "value with spaces")
+	m.Set("key.with.colon", "a:b")
+	m.Set("key.with.equals", "a=b")
+	m.Set("key.with.backslash", `C:\Program Files\Arduino`)
+	m.Set("key.with.newline", "first line\nsecond line")
+	m.Set("!comment.like.key", "still a key")
+
+	data, err := m.WriteToBytes()
+	require.NoError(t, err)
+
+	reloaded, err := LoadFromBytes(data)
+	require.NoError(t, err)
+	require.True(t, m.EqualsWithOrder(reloaded))
+}
+
+func TestLoadFromBytesEscapesAndContinuations(t *testing.T) {
+	data := []byte("! this is a comment\n" +
+		"key1=value1\\\n" +
+		"    continued\n" +
+		"key2 : tab\\tnewline\\nend\n" +
+		"key3=unicode\\u00e0\n" +
+		"  key4=value4\n")
+
+	m, err := LoadFromBytes(data)
+	require.NoError(t, err)
+	require.Equal(t, "value1continued", m.Get("key1"))
+	require.Equal(t, "tab\tnewline\nend", m.Get("key2"))
+	require.Equal(t, "unicodeà", m.Get("key3"))
+	require.Equal(t, "value4", m.Get("key4"))
+}
+
+func TestLoadFromReader(t *testing.T) {
+	data := strings.NewReader("yun.vid.0=0x2341\nyun.upload.tool=avrdude\n")
+	m, err := LoadFromReader(data)
+	require.NoError(t, err)
+	require.Equal(t, "avrdude", m.Get("yun.upload.tool"))
+
+	broken := strings.NewReader("yun.vid.0=0x2341\nyun.pid.1\nyun.upload.tool=avrdude\n")
+	m2, err2 := LoadFromReader(broken)
+	require.Error(t, err2)
+	require.Nil(t, m2)
+	var parseErr *ParseError
+	require.True(t, errors.As(err2, &parseErr))
+	require.Equal(t, 2, parseErr.Line)
+}
+
+func TestLoadAllCollectsEveryError(t *testing.T) {
+	data := strings.NewReader("good1=1\nbroken line one\ngood2=2\nbroken line two\n")
+	m, errs := LoadAll(data)
+	require.Len(t, errs, 2)
+	require.Equal(t, 2, errs[0].Line)
+	require.Equal(t, 4, errs[1].Line)
+	require.Equal(t, "1", m.Get("good1"))
+	require.Equal(t, "2", m.Get("good2"))
+}
+
+func TestLoadAllColumnAccountsForLeadingWhitespace(t *testing.T) {
+	data := strings.NewReader("   brokenline\n")
+	_, errs := LoadAll(data)
+	require.Len(t, errs, 1)
+	require.Equal(t, len("   brokenline")+1, errs[0].Column)
+}
+
+func TestLoadAllSurfacesScannerError(t *testing.T) {
+	oversized := strings.Repeat("x", 2*1024*1024)
+	data := strings.NewReader("good1=1\nkey=" + oversized + "\ngood2=2\n")
+	m, errs := LoadAll(data)
+	require.Equal(t, "1", m.Get("good1"))
+	require.False(t, m.ContainsKey("good2"))
+	require.NotEmpty(t, errs)
+	require.Contains(t, errs[len(errs)-1].Msg, "scanner error")
+}
+
 func TestAsSlice(t *testing.T) {
 	emptyProperties := NewMap()
 	require.Len(t, emptyProperties.AsSlice(), 0)
@@ -400,3 +479,179 @@ func TestAsSlice(t *testing.T) {
 		"key3=value3=somethingElse"},
 		properties.AsSlice())
 }
+
+func TestSplitQuotedString(t *testing.T) {
+	res, err := SplitQuotedString(`This 'is an' "Hello World!" example`, `'"`, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"This", "is an", "Hello World!", "example"}, res)
+
+	_, err = SplitQuotedString(`unterminated "quote`, `"`, false)
+	require.Error(t, err)
+}
+
+func TestSplitQuotedStringSepWithEscape(t *testing.T) {
+	res, err := SplitQuotedStringSep(`a\ b "c\"d" e`, `"`, '\\', " ", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a b", `c"d`, "e"}, res)
+
+	res, err = SplitQuotedStringSep("a\tb\rc", `"`, '\\', " \t\r", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, res)
+
+	_, err = SplitQuotedStringSep(`trailing\`, `"`, '\\', " ", false)
+	require.Error(t, err)
+}
+
+func TestLoadStrictWhitespaceSeparatorAndComments(t *testing.T) {
+	data := []byte("# a comment\n" +
+		"! another comment\n" +
+		"key1 value1\n" +
+		"key2 = value2\n" +
+		"key3: value3\n")
+
+	m, err := LoadStrictFromBytes(data)
+	require.NoError(t, err)
+	require.Equal(t, "value1", m.Get("key1"))
+	require.Equal(t, "value2", m.Get("key2"))
+	require.Equal(t, "value3", m.Get("key3"))
+	require.Equal(t, []string{" a comment", " another comment"}, m.CommentsFor("key1"))
+	require.Nil(t, m.CommentsFor("key2"))
+}
+
+func TestRemoveClearsComments(t *testing.T) {
+	m := NewMap()
+	m.Set("greeting", "hi")
+	m.SetComments("greeting", []string{" hello comment"})
+
+	m.Remove("greeting")
+	require.Nil(t, m.CommentsFor("greeting"))
+
+	m.Set("greeting", "bye")
+	require.Nil(t, m.CommentsFor("greeting"))
+}
+
+func TestMergeAndCloneCopyComments(t *testing.T) {
+	m, err := LoadStrictFromBytes([]byte("# a comment\nkey1=value1\n"))
+	require.NoError(t, err)
+
+	merged := NewMap()
+	merged.Merge(m)
+	require.Equal(t, []string{" a comment"}, merged.CommentsFor("key1"))
+
+	require.Equal(t, []string{" a comment"}, m.Clone().CommentsFor("key1"))
+}
+
+func TestStoreRoundTripWithCommentsAndASCIIOnly(t *testing.T) {
+	m := NewMap()
+	m.Set("greeting", "caffè")
+	m.SetComments("greeting", []string{" a non-ASCII value"})
+
+	data, err := m.Store(StoreOptions{WriteASCIIOnly: true})
+	require.NoError(t, err)
+	require.Contains(t, string(data), "\\u00e8")
+	require.NotContains(t, string(data), "caffè")
+	require.Contains(t, string(data), "# a non-ASCII value")
+
+	reloaded, err := LoadStrictFromBytes(data)
+	require.NoError(t, err)
+	require.True(t, m.EqualsWithOrder(reloaded))
+	require.Equal(t, []string{" a non-ASCII value"}, reloaded.CommentsFor("greeting"))
+}
+
+func TestStoreASCIIOnlySurrogatePairRoundTrip(t *testing.T) {
+	m := NewMap()
+	emoji := "hi \U0001F600 end"
+	m.Set("greeting", emoji)
+
+	data, err := m.Store(StoreOptions{WriteASCIIOnly: true})
+	require.NoError(t, err)
+	require.NotContains(t, string(data), emoji)
+	require.Contains(t, string(data), `\ud83d\ude00`)
+
+	reloaded, err := LoadStrictFromBytes(data)
+	require.NoError(t, err)
+	require.Equal(t, emoji, reloaded.Get("greeting"))
+}
+
+func TestExpandPropsInStringWithOptionsRecursiveExpansion(t *testing.T) {
+	m := NewMap()
+	m.Set("a", "{b}-{c}")
+	m.Set("b", "{d}")
+	m.Set("c", "value-c")
+	m.Set("d", "value-d")
+
+	res, referenced := m.ExpandPropsInStringWithOptions("{a}", ExpandOptions{})
+	require.Equal(t, "value-d-value-c", res)
+	require.ElementsMatch(t, []string{"a", "b", "c", "d"}, referenced)
+}
+
+func TestExpandPropsInStringWithOptionsCycle(t *testing.T) {
+	m := NewMap()
+	m.Set("a", "{b}")
+	m.Set("b", "{a}")
+
+	res, _ := m.ExpandPropsInStringWithOptions("{a}", ExpandOptions{})
+	require.Equal(t, "{a}", res)
+
+	var gotChain []string
+	res, _ = m.ExpandPropsInStringWithOptions("{a}", ExpandOptions{
+		OnCycle: func(chain []string) string {
+			gotChain = chain
+			return "<cycle>"
+		},
+	})
+	require.Equal(t, "<cycle>", res)
+	require.Equal(t, []string{"a", "b", "a"}, gotChain)
+}
+
+func TestExpandPropsInStringWithOptionsMissingAndDelimiters(t *testing.T) {
+	m := NewMap()
+	m.Set("known", "42")
+
+	res, referenced := m.ExpandPropsInStringWithOptions("[[known]] and [[unknown]]", ExpandOptions{
+		Open:  "[[",
+		Close: "]]",
+		OnMissing: func(key string) (string, bool) {
+			return "N/A", true
+		},
+	})
+	require.Equal(t, "42 and N/A", res)
+	require.Equal(t, []string{"known"}, referenced)
+}
+
+func BenchmarkSetOverwrite(b *testing.B) {
+	m := NewMap()
+	for i := 0; i < 10000; i++ {
+		m.Set(fmt.Sprintf("key%d", i), "value")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Set(fmt.Sprintf("key%d", i%10000), "value2")
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := NewMap()
+		for j := 0; j < 1000; j++ {
+			m.Set(fmt.Sprintf("key%d", j), "value")
+		}
+		b.StartTimer()
+		for j := 0; j < 1000; j++ {
+			m.Remove(fmt.Sprintf("key%d", j))
+		}
+	}
+}
+
+func BenchmarkMergeLarge(b *testing.B) {
+	source := NewMap()
+	for i := 0; i < 10000; i++ {
+		source.Set(fmt.Sprintf("key%d", i), "value")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := NewMap()
+		target.Merge(source)
+	}
+}
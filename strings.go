@@ -32,7 +32,6 @@ package properties
 import (
 	"fmt"
 	"strings"
-	"unicode/utf8"
 )
 
 // SplitQuotedString splits a string by spaces and at the same time allows
@@ -59,66 +58,110 @@ import (
 // closing quote character, it will return an error. In any case, the function
 // will return the split array up to the point where the error occurred.
 //
-// The function does not support escaping of quote characters.
+// The function does not support escaping of quote characters. Use
+// SplitQuotedStringSep if escaping or custom separators are needed.
 //
 // The function is UTF-8 safe.
 func SplitQuotedString(src string, quoteChars string, acceptEmptyArguments bool) ([]string, error) {
-	// Make a map of valid quote runes
-	isQuote := map[rune]bool{}
-	for _, c := range quoteChars {
-		isQuote[c] = true
-	}
+	return SplitQuotedStringSep(src, quoteChars, 0, " ", acceptEmptyArguments)
+}
 
+// SplitQuotedStringSep works like SplitQuotedString but adds support for
+// escaping and custom word separators.
+//
+// If escapeChar is not the zero rune, it may be used inside a word to have
+// the following character (a quote character, a separator, or escapeChar
+// itself) be taken literally instead of closing the current quote or word.
+// For example, with escapeChar set to `\`:
+//
+//	SplitQuotedStringSep(`"Hello World!" a\ b`, `"`, '\\', " ", false)
+//
+// returns the following array:
+//
+//	[]string{"Hello World!", "a b"}
+//
+// The separators parameter is a string containing all the characters that
+// are considered word boundaries, so that for example passing " \t\r" makes
+// tabs and carriage returns behave like spaces.
+//
+// If the function finds an opening quote character and does not find the
+// closing quote character, or finds escapeChar at the end of src with
+// nothing left to escape, it returns an error describing the rune position
+// at which the problem was found. In any case, the function returns the
+// split array up to the point where the error occurred.
+//
+// The function is UTF-8 safe.
+func SplitQuotedStringSep(src string, quoteChars string, escapeChar rune, separators string, acceptEmptyArguments bool) ([]string, error) {
+	isQuote := runeSet(quoteChars)
+	isSep := runeSet(separators)
+
+	runes := []rune(src)
 	result := []string{}
 
-	var escapingChar rune
-	escapedArg := ""
+	var current strings.Builder
+	atWordStart := true
+	var quoting rune
+	quoteStart := -1
 
-	for _, current := range strings.Split(src, " ") {
-		if escapingChar == 0 {
-			first, size := firstRune(current)
-			if !isQuote[first] {
-				if acceptEmptyArguments || len(strings.TrimSpace(current)) > 0 {
-					result = append(result, current)
-				}
-				continue
+	flush := func() {
+		if acceptEmptyArguments || len(strings.TrimSpace(current.String())) > 0 {
+			result = append(result, current.String())
+		}
+		current.Reset()
+		atWordStart = true
+	}
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		if escapeChar != 0 && c == escapeChar {
+			if i+1 >= len(runes) {
+				return result, fmt.Errorf("invalid escape sequence: dangling `%c` at position %d", escapeChar, i+1)
 			}
+			current.WriteRune(runes[i+1])
+			atWordStart = false
+			i++
+			continue
+		}
 
-			escapingChar = first
-			current = current[size:]
-			escapedArg = ""
+		if quoting != 0 {
+			if c == quoting && (i+1 >= len(runes) || isSep[runes[i+1]]) {
+				quoting = 0
+				continue
+			}
+			current.WriteRune(c)
+			continue
 		}
 
-		last, size := lastRune(current)
-		if last != escapingChar {
-			escapedArg += current + " "
+		if isSep[c] {
+			flush()
 			continue
 		}
 
-		escapedArg += current[:len(current)-size]
-		if acceptEmptyArguments || len(strings.TrimSpace(escapedArg)) > 0 {
-			result = append(result, escapedArg)
+		if atWordStart && isQuote[c] {
+			quoting = c
+			quoteStart = i
+			atWordStart = false
+			continue
 		}
-		escapingChar = 0
+
+		current.WriteRune(c)
+		atWordStart = false
 	}
 
-	if escapingChar != 0 {
-		return result, fmt.Errorf("invalid quoting, no closing `%c` char found", escapingChar)
+	if quoting != 0 {
+		return result, fmt.Errorf("invalid quoting, no closing `%c` char found for quote opened at position %d", quoting, quoteStart+1)
 	}
 
-	return result, nil
-}
+	flush()
 
-func firstRune(s string) (rune, int) {
-	if len(s) == 0 || !utf8.ValidString(s) {
-		return 0, 0
-	}
-	return utf8.DecodeRuneInString(s)
+	return result, nil
 }
 
-func lastRune(s string) (rune, int) {
-	if len(s) == 0 || !utf8.ValidString(s) {
-		return 0, 0
+func runeSet(s string) map[rune]bool {
+	set := map[rune]bool{}
+	for _, c := range s {
+		set[c] = true
 	}
-	return utf8.DecodeLastRuneInString(s)
+	return set
 }